@@ -0,0 +1,114 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kubestore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+// leaseDuration is how long a held Lease is valid for without renewal before
+// another replica may consider it abandoned and take over.
+const leaseDuration = 15 * time.Second
+
+// holderIdentity returns the identity this replica acquires leaseName under.
+// Pods running under a Deployment/StatefulSet always have a stable, unique
+// hostname, so that's used rather than inventing a random ID.
+func holderIdentity() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return fmt.Sprintf("unknown-%d", os.Getpid())
+}
+
+// runLeaderElection repeatedly tries to acquire and renew s.leaseName,
+// updating s.isLeader to reflect whether this replica currently holds it. It
+// runs until ctx is done.
+func (s *Store) runLeaderElection(ctx context.Context) {
+	id := holderIdentity()
+	t := time.NewTicker(leaseDuration / 3)
+	defer t.Stop()
+
+	s.tryAcquireOrRenewLease(ctx, id)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.tryAcquireOrRenewLease(ctx, id)
+		}
+	}
+}
+
+func (s *Store) tryAcquireOrRenewLease(ctx context.Context, id string) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	lease, err := s.client.GetLease(ctx, s.leaseName)
+	if err != nil && !kubeclient.IsNotFoundErr(err) {
+		s.logf("kubestore: error getting Lease %s: %v", s.leaseName, err)
+		s.setLeader(false)
+		return
+	}
+	now := time.Now()
+	if err == nil && lease.HolderIdentity != id && !leaseExpired(lease, now) {
+		// Someone else holds a current lease; we're not the leader.
+		s.setLeader(false)
+		return
+	}
+
+	if err != nil { // IsNotFoundErr: no Lease yet, create it
+		newLease := &kubeapi.Lease{
+			TypeMeta: kubeapi.TypeMeta{
+				APIVersion: "coordination.k8s.io/v1",
+				Kind:       "Lease",
+			},
+			ObjectMeta: kubeapi.ObjectMeta{
+				Name: s.leaseName,
+			},
+			HolderIdentity:       id,
+			LeaseDurationSeconds: int32(leaseDuration / time.Second),
+			RenewTime:            now,
+		}
+		if err := s.client.CreateLease(ctx, newLease); err != nil {
+			s.logf("kubestore: error creating Lease %s: %v", s.leaseName, err)
+			s.setLeader(false)
+			return
+		}
+		s.setLeader(true)
+		return
+	}
+
+	// Mutate the Lease we just fetched, rather than constructing a new
+	// object, so its ResourceVersion comes along for UpdateLease's
+	// optimistic-concurrency check. Without it, two replicas racing to
+	// take over an expired lease could both succeed and both believe
+	// they're the leader.
+	lease.HolderIdentity = id
+	lease.LeaseDurationSeconds = int32(leaseDuration / time.Second)
+	lease.RenewTime = now
+	if err := s.client.UpdateLease(ctx, lease); err != nil {
+		s.logf("kubestore: error updating Lease %s: %v", s.leaseName, err)
+		s.setLeader(false)
+		return
+	}
+	s.setLeader(true)
+}
+
+// leaseExpired reports whether lease, last renewed at its RenewTime, is no
+// longer valid as of now and so may be taken over by another replica.
+func leaseExpired(lease *kubeapi.Lease, now time.Time) bool {
+	return !now.Before(lease.RenewTime.Add(leaseDuration))
+}
+
+func (s *Store) setLeader(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.isLeader = v
+}
@@ -0,0 +1,33 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kubestore
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/kube/kubeapi"
+)
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		renewTime time.Time
+		want      bool
+	}{
+		{"just renewed", now, false},
+		{"renewed just under leaseDuration ago", now.Add(-leaseDuration + time.Second), false},
+		{"renewed exactly leaseDuration ago", now.Add(-leaseDuration), true},
+		{"renewed well past leaseDuration ago", now.Add(-2 * leaseDuration), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease := &kubeapi.Lease{RenewTime: tt.renewTime}
+			if got := leaseExpired(lease, now); got != tt.want {
+				t.Errorf("leaseExpired(renewTime=%v, now=%v) = %v, want %v", tt.renewTime, now, got, tt.want)
+			}
+		})
+	}
+}
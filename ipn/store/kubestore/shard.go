@@ -0,0 +1,316 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kubestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"golang.org/x/sync/errgroup"
+	"tailscale.com/kube/kubeapi"
+	"tailscale.com/kube/kubeclient"
+)
+
+// manifestKey is the Secret Data key under which the shard manifest is
+// stored once a Store's state no longer fits in a single Secret.
+const manifestKey = "_tailscale-shard-manifest"
+
+// shardThreshold is the total Secret Data size above which WriteState spills
+// state into sibling "-shard-N" Secrets. Kubernetes caps a Secret at ~1MiB;
+// this leaves headroom for the manifest itself and API object overhead.
+const shardThreshold = 900 * 1024 // 900 KiB
+
+// maxConcurrentShardFetches bounds how many shard Secrets loadState fetches
+// at once.
+const maxConcurrentShardFetches = 8
+
+// shardManifest records where a Store's state lives when it's been spilled
+// across sibling Secrets.
+type shardManifest struct {
+	Shards []shardRef `json:"shards"`
+}
+
+// shardRef identifies one shard Secret and lets loadState verify its
+// contents weren't corrupted or written by an incompatible version.
+type shardRef struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func shardSecretName(base string, n int) string {
+	return fmt.Sprintf("%s-shard-%d", base, n)
+}
+
+// packData deterministically serializes data so its hash doesn't depend on
+// Go's randomized map iteration order.
+func packData(data map[string][]byte) []byte {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%d:%s%d:", len(k), k, len(data[k]))
+		buf.Write(data[k])
+	}
+	return buf.Bytes()
+}
+
+func hashData(data map[string][]byte) string {
+	sum := sha256.Sum256(packData(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func sizeOfData(data map[string][]byte) int {
+	n := 0
+	for k, v := range data {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// bucketData splits data into one or more maps, none of which exceeds
+// threshold serialized bytes, unless a single entry alone does (in which
+// case it gets its own bucket).
+func bucketData(data map[string][]byte, threshold int) []map[string][]byte {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var shards []map[string][]byte
+	cur := map[string][]byte{}
+	curSize := 0
+	for _, k := range keys {
+		v := data[k]
+		entrySize := len(k) + len(v)
+		if curSize > 0 && curSize+entrySize > threshold {
+			shards = append(shards, cur)
+			cur = map[string][]byte{}
+			curSize = 0
+		}
+		cur[k] = v
+		curSize += entrySize
+	}
+	if len(cur) > 0 || len(shards) == 0 {
+		shards = append(shards, cur)
+	}
+	return shards
+}
+
+// putSecretData creates name with the given Data if it doesn't exist, or
+// overwrites its Data entirely otherwise, preferring a JSON patch of the
+// /data field over a full Secret rewrite when s.canPatch, same as
+// WriteState.
+func (s *Store) putSecretData(ctx context.Context, name string, data map[string][]byte) error {
+	secret, err := s.client.GetSecret(ctx, name)
+	if err != nil {
+		if kubeclient.IsNotFoundErr(err) {
+			return s.client.CreateSecret(ctx, &kubeapi.Secret{
+				TypeMeta: kubeapi.TypeMeta{
+					APIVersion: "v1",
+					Kind:       "Secret",
+				},
+				ObjectMeta: kubeapi.ObjectMeta{
+					Name: name,
+				},
+				Data: data,
+			})
+		}
+		return err
+	}
+
+	if s.canPatch {
+		op := "replace"
+		if len(secret.Data) == 0 { // if user has pre-created a blank Secret
+			op = "add"
+		}
+		m := []kubeclient.JSONPatch{
+			{
+				Op:    op,
+				Path:  "/data",
+				Value: data,
+			},
+		}
+		if err := s.client.JSONPatchSecret(ctx, name, m); err != nil {
+			return fmt.Errorf("error patching Secret %s with a /data field: %w", name, err)
+		}
+		return nil
+	}
+
+	secret.Data = data
+	return s.client.UpdateSecret(ctx, secret)
+}
+
+// maybeSpillToShards rewrites the primary Secret to hold only a shard
+// manifest, with the full state spread across one or more sibling
+// "-shard-N" Secrets, once the in-memory state (s.lastData) exceeds
+// shardThreshold. Store doesn't currently un-shard state that shrinks back
+// under the threshold; Compact only removes shards the manifest no longer
+// references.
+func (s *Store) maybeSpillToShards(ctx context.Context) error {
+	s.mu.Lock()
+	data := make(map[string][]byte, len(s.lastData))
+	for k, v := range s.lastData {
+		data[k] = v
+	}
+	maxShard := s.maxShardIndex
+	s.mu.Unlock()
+
+	if sizeOfData(data) <= shardThreshold {
+		return nil
+	}
+
+	buckets := bucketData(data, shardThreshold)
+	manifest := shardManifest{Shards: make([]shardRef, len(buckets))}
+	for i, bucket := range buckets {
+		name := shardSecretName(s.secretName, i)
+		if err := s.putSecretData(ctx, name, bucket); err != nil {
+			return fmt.Errorf("error writing shard Secret %s: %w", name, err)
+		}
+		manifest.Shards[i] = shardRef{
+			Name:   name,
+			Size:   sizeOfData(bucket),
+			SHA256: hashData(bucket),
+		}
+		if i > maxShard {
+			maxShard = i
+		}
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := s.putSecretData(ctx, s.secretName, map[string][]byte{manifestKey: manifestBytes}); err != nil {
+		return fmt.Errorf("error writing shard manifest: %w", err)
+	}
+
+	s.mu.Lock()
+	s.maxShardIndex = maxShard
+	s.mu.Unlock()
+	return nil
+}
+
+// resolveData returns data's full state. If data holds a shard manifest
+// rather than the state itself, resolveData fetches and verifies the
+// referenced shard Secrets in parallel and stitches their contents back
+// together.
+func (s *Store) resolveData(ctx context.Context, data map[string][]byte) (map[string][]byte, error) {
+	manifestBytes, ok := data[manifestKey]
+	if !ok {
+		return data, nil
+	}
+	var manifest shardManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("error parsing shard manifest: %w", err)
+	}
+
+	// A manifest loaded from the Secret (rather than one we just wrote
+	// ourselves) is the only record a freshly started replica has of how
+	// many shards exist; without tracking its high-water mark here,
+	// Compact would never see shards an older, larger manifest left
+	// behind once the live count shrinks.
+	if n := len(manifest.Shards) - 1; n >= 0 {
+		s.mu.Lock()
+		if n > s.maxShardIndex {
+			s.maxShardIndex = n
+		}
+		s.mu.Unlock()
+	}
+
+	shardData := make([]map[string][]byte, len(manifest.Shards))
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(maxConcurrentShardFetches)
+	for i, ref := range manifest.Shards {
+		i, ref := i, ref
+		eg.Go(func() error {
+			secret, err := s.client.GetSecret(ctx, ref.Name)
+			if err != nil {
+				return fmt.Errorf("error fetching shard Secret %s: %w", ref.Name, err)
+			}
+			if got := hashData(secret.Data); got != ref.SHA256 {
+				return fmt.Errorf("shard Secret %s failed SHA-256 verification", ref.Name)
+			}
+			shardData[i] = secret.Data
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string][]byte)
+	for _, sd := range shardData {
+		for k, v := range sd {
+			merged[k] = v
+		}
+	}
+	// WriteState patches a new or changed key directly into the primary
+	// Secret before maybeSpillToShards gets a chance to re-bucket it into
+	// its owning shard. If that follow-up spill then fails, the primary
+	// is left holding the stale manifest next to the just-written key.
+	// Overlaying any such leftover non-manifest keys on top of the
+	// shard-resolved data (they're newer than what the shards have)
+	// ensures a failed spill can't hide an otherwise-successful write.
+	for k, v := range data {
+		if k == manifestKey {
+			continue
+		}
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// Compact garbage-collects sibling shard Secrets that the current manifest
+// no longer references, e.g. after keys were deleted and the state shrank
+// enough to need fewer shards than were ever written.
+func (s *Store) Compact(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	secret, err := s.client.GetSecret(ctx, s.secretName)
+	if err != nil {
+		return err
+	}
+	manifestBytes, ok := secret.Data[manifestKey]
+	if !ok {
+		return nil // state was never sharded
+	}
+	var manifest shardManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("error parsing shard manifest: %w", err)
+	}
+	live := make(map[string]bool, len(manifest.Shards))
+	for _, ref := range manifest.Shards {
+		live[ref.Name] = true
+	}
+
+	s.mu.Lock()
+	maxShard := s.maxShardIndex
+	s.mu.Unlock()
+
+	var errs []error
+	for i := 0; i <= maxShard; i++ {
+		name := shardSecretName(s.secretName, i)
+		if live[name] {
+			continue
+		}
+		if err := s.client.DeleteSecret(ctx, name); err != nil && !kubeclient.IsNotFoundErr(err) {
+			errs = append(errs, fmt.Errorf("error deleting orphaned shard Secret %s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("kubestore: Compact: %v", errs)
+	}
+	return nil
+}
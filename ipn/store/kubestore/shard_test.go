@@ -0,0 +1,97 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package kubestore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHashDataDeterministic(t *testing.T) {
+	data := map[string][]byte{
+		"b": []byte("two"),
+		"a": []byte("one"),
+		"c": []byte("three"),
+	}
+	want := hashData(data)
+	for i := 0; i < 10; i++ {
+		if got := hashData(data); got != want {
+			t.Fatalf("hashData not deterministic across map iteration order: got %s, want %s", got, want)
+		}
+	}
+
+	other := map[string][]byte{
+		"a": []byte("one"),
+		"b": []byte("two"),
+		"c": []byte("three!"),
+	}
+	if hashData(other) == want {
+		t.Fatal("hashData returned the same hash for different data")
+	}
+}
+
+func TestBucketDataThreshold(t *testing.T) {
+	data := map[string][]byte{
+		"k1": make([]byte, 40),
+		"k2": make([]byte, 40),
+		"k3": make([]byte, 40),
+	}
+	buckets := bucketData(data, 50)
+	if len(buckets) != 3 {
+		t.Fatalf("got %d buckets, want 3 (no bucket should exceed threshold)", len(buckets))
+	}
+	for _, b := range buckets {
+		if sizeOfData(b) > 50 {
+			t.Errorf("bucket %v exceeds threshold: size %d", b, sizeOfData(b))
+		}
+	}
+
+	// All keys must round-trip through bucketing exactly once.
+	got := make(map[string][]byte)
+	for _, b := range buckets {
+		for k, v := range b {
+			if _, dup := got[k]; dup {
+				t.Fatalf("key %q appeared in more than one bucket", k)
+			}
+			got[k] = v
+		}
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Fatalf("bucketData lost or altered data: got %v, want %v", got, data)
+	}
+}
+
+func TestBucketDataOversizedEntry(t *testing.T) {
+	data := map[string][]byte{"big": make([]byte, 100)}
+	buckets := bucketData(data, 50)
+	if len(buckets) != 1 || len(buckets[0]) != 1 {
+		t.Fatalf("an entry larger than threshold should get its own bucket, got %v", buckets)
+	}
+}
+
+func TestBucketDataEmpty(t *testing.T) {
+	buckets := bucketData(map[string][]byte{}, 50)
+	if len(buckets) != 1 || len(buckets[0]) != 0 {
+		t.Fatalf("bucketData(empty) = %v, want a single empty bucket", buckets)
+	}
+}
+
+func TestShardManifestJSONRoundTrip(t *testing.T) {
+	want := shardManifest{Shards: []shardRef{
+		{Name: "foo-shard-0", Size: 123, SHA256: "deadbeef"},
+		{Name: "foo-shard-1", Size: 456, SHA256: "feedface"},
+	}}
+	b, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got shardManifest
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
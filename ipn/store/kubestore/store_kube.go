@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"tailscale.com/ipn"
@@ -27,14 +28,53 @@ type Store struct {
 	client     kubeclient.Client
 	canPatch   bool
 	secretName string
+	logf       logger.Logf
 
+	leaderElection bool
+	leaseName      string
+
+	// mu guards memory, lastData, isLeader and onStateChanged, all of
+	// which can be mutated by the watchSecret goroutine in addition to the
+	// ReadState/WriteState callers.
+	mu sync.Mutex
 	// memory holds the latest tailscale state. Writes write state to a kube Secret and memory, Reads read from
 	// memory.
 	memory mem.Store
+	// lastData is the Secret's Data as of the last load or watch event, used to
+	// compute which keys changed so onStateChanged fires only for those.
+	lastData map[string][]byte
+	// isLeader is whether this replica currently holds leaseName. Always true
+	// when leaderElection is false.
+	isLeader bool
+	// onStateChanged, if non-nil, is called whenever watchSecret observes a peer
+	// replica change the value of a state key.
+	onStateChanged func(ipn.StateKey)
+	// maxShardIndex is the highest "-shard-N" index ever written by this
+	// Store, used by Compact to know how far to look for orphans.
+	maxShardIndex int
+
+	watchCancel context.CancelFunc
+}
+
+// ErrNotLeader is returned by WriteState when leader election is enabled and
+// this replica does not currently hold the lease.
+var ErrNotLeader = fmt.Errorf("kubestore: this replica is not the leader")
+
+// Option configures optional Store behavior.
+type Option func(*Store)
+
+// WithLeaderElection makes WriteState refuse to write (returning ErrNotLeader)
+// unless this replica holds the named coordination.k8s.io/v1 Lease, so that of
+// several replicas sharing secretName, only the leader mutates it.
+func WithLeaderElection(leaseName string) Option {
+	return func(s *Store) {
+		s.leaderElection = true
+		s.leaseName = leaseName
+	}
 }
 
 // New returns a new Store that persists to the named Secret.
-func New(_ logger.Logf, secretName string) (*Store, error) {
+func New(logf logger.Logf, secretName string, opts ...Option) (*Store, error) {
 	c, err := kubeclient.New()
 	if err != nil {
 		return nil, err
@@ -47,18 +87,54 @@ func New(_ logger.Logf, secretName string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
 	s := &Store{
 		client:     c,
 		canPatch:   canPatch,
 		secretName: secretName,
+		logf:       logf,
+		isLeader:   true,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.leaderElection {
+		s.isLeader = false
 	}
 	// Load latest state from kube Secret if it already exists.
 	if err := s.loadState(); err != nil && err != ipn.ErrStateNotExist {
 		return nil, fmt.Errorf("error loading state from kube Secret: %w", err)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.watchCancel = cancel
+	go s.watchSecret(ctx)
+	if s.leaderElection {
+		go s.runLeaderElection(ctx)
+	}
+
 	return s, nil
 }
 
+// OnStateChanged registers f to be called whenever the Secret watch observes a peer
+// replica change a state key's value. Only one callback can be registered at
+// a time; a later call replaces an earlier one.
+func (s *Store) OnStateChanged(f func(ipn.StateKey)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStateChanged = f
+}
+
+// Close stops the background Secret watch (and leader election, if enabled)
+// goroutines started by New.
+func (s *Store) Close() {
+	if s.watchCancel != nil {
+		s.watchCancel()
+	}
+}
+
 func (s *Store) SetDialer(d func(ctx context.Context, network, address string) (net.Conn, error)) {
 	s.client.SetDialer(d)
 }
@@ -72,9 +148,34 @@ func (s *Store) ReadState(id ipn.StateKey) ([]byte, error) {
 
 // WriteState implements the StateStore interface.
 func (s *Store) WriteState(id ipn.StateKey, bs []byte) (err error) {
+	s.mu.Lock()
+	isLeader := s.isLeader
+	s.mu.Unlock()
+	if s.leaderElection && !isLeader {
+		return ErrNotLeader
+	}
 	defer func() {
-		if err == nil {
-			s.memory.WriteState(ipn.StateKey(sanitizeKey(id)), bs)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.memory.WriteState(ipn.StateKey(sanitizeKey(id)), bs)
+		if s.lastData == nil {
+			s.lastData = make(map[string][]byte)
+		}
+		s.lastData[sanitizeKey(id)] = bs
+		s.mu.Unlock()
+
+		spillCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if serr := s.maybeSpillToShards(spillCtx); serr != nil {
+			// id's value was itself written successfully above, but we
+			// failed to keep the primary Secret under its size limit.
+			// Surface that instead of swallowing it, so callers (and
+			// metrics/alerting built on WriteState's error) can see the
+			// Store is at risk of exceeding the ~1MiB Secret cap.
+			s.logf("kubestore: error spilling state to shard Secrets: %v", serr)
+			err = fmt.Errorf("state for %q was written, but spilling oversized state to shard Secrets failed: %w", id, serr)
 		}
 	}()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -142,10 +243,71 @@ func (s *Store) loadState() error {
 		}
 		return err
 	}
-	s.memory.LoadFromMap(secret.Data)
+	data, err := s.resolveData(ctx, secret.Data)
+	if err != nil {
+		return fmt.Errorf("error resolving sharded state: %w", err)
+	}
+	s.applySecretData(data)
 	return nil
 }
 
+// applySecretData loads data into memory, replacing lastData, and reports via
+// onStateChanged any key whose value differs from what was there before. It
+// does not report keys that were present in lastData but are absent from
+// data: callers that need full reconciliation (e.g. noticing a peer deleted
+// a key) can't rely on onStateChanged alone.
+func (s *Store) applySecretData(data map[string][]byte) {
+	s.mu.Lock()
+	prev := s.lastData
+	s.memory.LoadFromMap(data)
+	s.lastData = data
+	onStateChanged := s.onStateChanged
+	s.mu.Unlock()
+
+	if onStateChanged == nil {
+		return
+	}
+	for k, v := range data {
+		if pv, ok := prev[k]; !ok || string(pv) != string(v) {
+			onStateChanged(ipn.StateKey(k))
+		}
+	}
+}
+
+// watchSecret watches s.secretName for changes made by peer replicas (e.g.
+// another replica rotating its node key) and applies them to s.memory so that
+// ReadState reflects the latest state even though this replica didn't write
+// it itself. It runs until ctx is done.
+func (s *Store) watchSecret(ctx context.Context) {
+	for ctx.Err() == nil {
+		events, err := s.client.WatchSecret(ctx, s.secretName)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			s.logf("kubestore: error watching Secret %s, retrying: %v", s.secretName, err)
+			time.Sleep(timeout)
+			continue
+		}
+		for ev := range events {
+			if ev.Type != kubeclient.EventTypeModified {
+				continue
+			}
+			data, err := s.resolveData(ctx, ev.Secret.Data)
+			if err != nil {
+				s.logf("kubestore: error resolving sharded state from watch event: %v", err)
+				continue
+			}
+			s.applySecretData(data)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// The watch channel closed (e.g. server-side timeout); loop
+		// around and re-establish it.
+	}
+}
+
 func sanitizeKey(k ipn.StateKey) string {
 	// The only valid characters in a Kubernetes secret key are alphanumeric, -,
 	// _, and .
@@ -59,6 +59,25 @@ func (ip IP) String() string {
 	return fmt.Sprintf("%d.%d.%d.%d", byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
 }
 
+// IP6 is an IPv6 address.
+type IP6 [16]byte
+
+// NewIP6 converts a standard library IP address into an IP6.
+// It panics if b is not an IPv6 address.
+func NewIP6(b net.IP) IP6 {
+	b16 := b.To16()
+	if b16 == nil || b.To4() != nil {
+		panic(fmt.Sprintf("To16(%v) failed", b))
+	}
+	var ip IP6
+	copy(ip[:], b16)
+	return ip
+}
+
+func (ip IP6) String() string {
+	return net.IP(ip[:]).String()
+}
+
 // ICMP types.
 const (
 	ICMPEchoReply    = 0x00
@@ -73,22 +92,63 @@ const (
 	TCPSynAck = TCPSyn | TCPAck
 )
 
+// ICMPv6 types. ICMPv6 uses its own numbering, disjoint from ICMPv4's
+// (in particular type 3 is Destination Unreachable in v4 but Time
+// Exceeded in v6), even though both share an IPProto (ICMP).
+const (
+	ICMPv6Unreachable  = 0x01 // 1
+	ICMPv6PacketTooBig = 0x02 // 2
+	ICMPv6TimeExceeded = 0x03 // 3
+	ICMPv6ParamProblem = 0x04 // 4
+	ICMPv6EchoRequest  = 0x80 // 128
+	ICMPv6EchoReply    = 0x81 // 129
+)
+
+// ip6HeaderLen is the length in bytes of a fixed IPv6 header, not
+// including any extension headers.
+const ip6HeaderLen = 40
+
+// maxIP6ExtensionHeaders caps the number of IPv6 extension headers
+// we'll walk through looking for the ultimate NextHeader, so that a
+// maliciously crafted chain of zero-length headers can't make us loop
+// forever.
+const maxIP6ExtensionHeaders = 8
+
+// IPv6 extension header types that we know how to skip over.
+const (
+	ip6HopByHop    = 0
+	ip6Routing     = 43
+	ip6Fragment    = 44
+	ip6DestOptions = 60
+)
+
 type QDecode struct {
 	b      []byte // Packet buffer that this decodes
 	subofs int    // byte offset of IP subprotocol
-
-	IPProto  IPProto // IP subprotocol (UDP, TCP, etc)
-	SrcIP    IP      // IP source address
-	DstIP    IP      // IP destination address
-	SrcPort  uint16  // TCP/UDP source port
-	DstPort  uint16  // TCP/UDP destination port
-	TCPFlags uint8   // TCP flags (SYN, ACK, etc)
+	// rawPayload is set by DecodeUDPGRO for each segment it emits: b holds
+	// only that segment's application payload, not a full IP packet, so
+	// Trim (which otherwise reads an IPv4 length field out of b) and Sub
+	// must treat b as already scoped to the segment.
+	rawPayload bool
+
+	IPVersion uint8   // 4 or 6
+	IPProto   IPProto // IP subprotocol (UDP, TCP, etc)
+	SrcIP     IP      // IPv4 source address, valid when IPVersion == 4
+	DstIP     IP      // IPv4 destination address, valid when IPVersion == 4
+	SrcIP6    IP6     // IPv6 source address, valid when IPVersion == 6
+	DstIP6    IP6     // IPv6 destination address, valid when IPVersion == 6
+	SrcPort   uint16  // TCP/UDP source port
+	DstPort   uint16  // TCP/UDP destination port
+	TCPFlags  uint8   // TCP flags (SYN, ACK, etc)
 }
 
 func (q *QDecode) String() string {
 	if q.IPProto == Junk {
 		return "Junk{}"
 	}
+	if q.IPVersion == 6 {
+		return fmt.Sprintf("%s{%s:%d > %s:%d}", q.IPProto, q.SrcIP6, q.SrcPort, q.DstIP6, q.DstPort)
+	}
 	sb := strbuilder.Get()
 	sb.WriteString(q.IPProto.String())
 	sb.WriteByte('{')
@@ -166,19 +226,75 @@ func GenICMP(srcIP, dstIP IP, ipid uint16, icmpType, icmpCode uint8, payload []b
 	return out
 }
 
+// GenICMPv6 returns the bytes of an ICMPv6 packet.
+// If payload is too short or too long, it returns nil.
+func GenICMPv6(srcIP, dstIP IP6, icmpType, icmpCode uint8, payload []byte) []byte {
+	if len(payload) < 4 {
+		return nil
+	}
+	if len(payload) > 65535-8 {
+		return nil
+	}
+
+	icmpLen := 4 + len(payload)
+	out := make([]byte, ip6HeaderLen+icmpLen)
+	out[0] = 0x60 // IPv6, traffic class 0, flow label 0
+	put16(out[4:6], uint16(icmpLen))
+	out[6] = 58 // Next header: ICMPv6
+	out[7] = 64 // Hop limit
+	copy(out[8:24], srcIP[:])
+	copy(out[24:40], dstIP[:])
+
+	out[40] = icmpType
+	out[41] = icmpCode
+	//out[42:44] = 0x00  // blank ICMPv6 checksum
+	copy(out[44:], payload)
+
+	put16(out[42:44], icmp6Checksum(srcIP, dstIP, out[40:]))
+	return out
+}
+
+// icmp6Checksum computes the ICMPv6 checksum of icmp (the ICMPv6
+// header and payload, starting at the ICMPv6 type byte) per RFC 4443
+// §2.3 / RFC 2460 §8.1: the ones'-complement checksum of icmp
+// prepended with a pseudo-header of src(16)+dst(16)+length(4)+zeros(3)+NextHeader(1).
+func icmp6Checksum(srcIP, dstIP IP6, icmp []byte) uint16 {
+	pseudo := make([]byte, 40+len(icmp))
+	copy(pseudo[0:16], srcIP[:])
+	copy(pseudo[16:32], dstIP[:])
+	put32(pseudo[32:36], uint32(len(icmp)))
+	pseudo[36], pseudo[37], pseudo[38] = 0, 0, 0
+	pseudo[39] = 58 // Next header: ICMPv6
+	copy(pseudo[40:], icmp)
+	return ipChecksum(pseudo)
+}
+
 // An extremely simple packet decoder for basic IPv4 packet types.
 // It extracts only the subprotocol id, IP addresses, and (if any) ports,
 // and shouldn't need any memory allocation.
 func (q *QDecode) Decode(b []byte) {
 	q.b = nil
 
-	if len(b) < 20 {
+	if len(b) < 1 {
 		q.IPProto = Junk
 		return
 	}
-	// Check that it's IPv4.
-	// TODO(apenwarr): consider IPv6 support
-	if ((b[0] & 0xF0) >> 4) != 4 {
+	switch (b[0] & 0xF0) >> 4 {
+	case 4:
+		q.IPVersion = 4
+		q.decode4(b)
+	case 6:
+		q.IPVersion = 6
+		q.decode6(b)
+	default:
+		q.IPProto = Junk
+	}
+}
+
+// decode4 decodes an IPv4 packet into q. It's split out of Decode
+// so that decode6 can live alongside it without one giant function.
+func (q *QDecode) decode4(b []byte) {
+	if len(b) < 20 {
 		q.IPProto = Junk
 		return
 	}
@@ -279,15 +395,125 @@ func (q *QDecode) Decode(b []byte) {
 	}
 }
 
+// decode6 decodes an IPv6 packet into q. It walks any extension
+// headers to find the ultimate next-header/payload, mirroring the
+// fragment defense in decode4: a fragment header with a non-zero
+// offset is treated as Junk rather than reassembled.
+func (q *QDecode) decode6(b []byte) {
+	if len(b) < ip6HeaderLen {
+		q.IPProto = Junk
+		return
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(b[4:6]))
+	if len(b) < ip6HeaderLen+payloadLen {
+		q.IPProto = Junk
+		return
+	}
+
+	q.SrcIP6 = asIP6(b[8:24])
+	q.DstIP6 = asIP6(b[24:40])
+
+	nextHeader := b[6]
+	ofs := ip6HeaderLen
+	for i := 0; i < maxIP6ExtensionHeaders; i++ {
+		switch nextHeader {
+		case ip6HopByHop, ip6Routing, ip6DestOptions:
+			if len(b) < ofs+2 {
+				q.IPProto = Junk
+				return
+			}
+			hdrLen := (int(b[ofs+1]) + 1) * 8
+			if len(b) < ofs+hdrLen {
+				q.IPProto = Junk
+				return
+			}
+			nextHeader = b[ofs]
+			ofs += hdrLen
+			continue
+		case ip6Fragment:
+			if len(b) < ofs+8 {
+				q.IPProto = Junk
+				return
+			}
+			fragOfs := binary.BigEndian.Uint16(b[ofs+2:ofs+4]) >> 3
+			if fragOfs != 0 {
+				// Not the first fragment; we can't read the
+				// subprotocol header, so treat it as junk
+				// rather than pass it through unchecked.
+				q.IPProto = Junk
+				return
+			}
+			nextHeader = b[ofs]
+			ofs += 8
+			continue
+		}
+		break
+	}
+
+	q.subofs = ofs
+	sub := b[q.subofs:]
+
+	switch nextHeader {
+	case 58: // ICMPv6
+		if len(sub) < 8 {
+			q.IPProto = Junk
+			return
+		}
+		q.IPProto = ICMP
+		q.SrcPort = 0
+		q.DstPort = 0
+		q.b = b
+	case 6: // TCP
+		if len(sub) < 20 {
+			q.IPProto = Junk
+			return
+		}
+		q.IPProto = TCP
+		q.SrcPort = binary.BigEndian.Uint16(sub[0:2])
+		q.DstPort = binary.BigEndian.Uint16(sub[2:4])
+		q.TCPFlags = sub[13] & 0x3F
+		q.b = b
+	case 17: // UDP
+		if len(sub) < 8 {
+			q.IPProto = Junk
+			return
+		}
+		q.IPProto = UDP
+		q.SrcPort = binary.BigEndian.Uint16(sub[0:2])
+		q.DstPort = binary.BigEndian.Uint16(sub[2:4])
+		q.b = b
+	default:
+		q.IPProto = Junk
+	}
+}
+
+func asIP6(b []byte) IP6 {
+	var ip IP6
+	copy(ip[:], b)
+	return ip
+}
+
 // Returns a subset of the IP subprotocol section.
 func (q *QDecode) Sub(begin, n int) []byte {
 	return q.b[q.subofs+begin : q.subofs+begin+n]
 }
 
-// Trim trims the buffer to its IPv4 length.
+// Trim trims the buffer to its IP length.
 // Sometimes packets arrive from an interface with extra bytes on the end.
 // This removes them.
+//
+// For a QDecode produced by DecodeUDPGRO, b is already scoped to a single
+// GRO segment's payload with no IP header to read a length from, so Trim
+// is a no-op.
 func (q *QDecode) Trim() []byte {
+	if q.rawPayload {
+		return q.b
+	}
+	if q.IPVersion == 6 {
+		n := ip6HeaderLen + int(binary.BigEndian.Uint16(q.b[4:6]))
+		return q.b[:n]
+	}
 	n := binary.BigEndian.Uint16(q.b[2:4])
 	return q.b[:n]
 }
@@ -298,37 +524,54 @@ func (q *QDecode) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
-// IsError reports whether q is an IPv4 ICMP "Error" packet.
+// IsError reports whether q is an ICMP (v4 or v6) "Error" packet.
 func (q *QDecode) IsError() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if q.IPProto != ICMP || len(q.b) < q.subofs+8 {
+		return false
+	}
+	if q.IPVersion == 6 {
 		switch q.b[q.subofs] {
-		case ICMPUnreachable, ICMPTimeExceeded:
+		case ICMPv6Unreachable, ICMPv6PacketTooBig, ICMPv6TimeExceeded, ICMPv6ParamProblem:
 			return true
 		}
+		return false
+	}
+	switch q.b[q.subofs] {
+	case ICMPUnreachable, ICMPTimeExceeded:
+		return true
 	}
 	return false
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Request.
+// IsEchoRequest reports whether q is an ICMP (v4 or v6) Echo Request.
 func (q *QDecode) IsEchoRequest() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return q.b[q.subofs] == ICMPEchoRequest && q.b[q.subofs+1] == 0
+	if q.IPProto != ICMP || len(q.b) < q.subofs+8 {
+		return false
 	}
-	return false
+	if q.IPVersion == 6 {
+		return q.b[q.subofs] == ICMPv6EchoRequest && q.b[q.subofs+1] == 0
+	}
+	return q.b[q.subofs] == ICMPEchoRequest && q.b[q.subofs+1] == 0
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Response.
+// IsEchoResponse reports whether q is an ICMP (v4 or v6) Echo Response.
 func (q *QDecode) IsEchoResponse() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return q.b[q.subofs] == ICMPEchoReply && q.b[q.subofs+1] == 0
+	if q.IPProto != ICMP || len(q.b) < q.subofs+8 {
+		return false
 	}
-	return false
+	if q.IPVersion == 6 {
+		return q.b[q.subofs] == ICMPv6EchoReply && q.b[q.subofs+1] == 0
+	}
+	return q.b[q.subofs] == ICMPEchoReply && q.b[q.subofs+1] == 0
 }
 
-// EchoResponse returns an IPv4 ICMP echo reply to the request in q.
+// EchoRespond returns an ICMP (v4 or v6) echo reply to the request in q.
 func (q *QDecode) EchoRespond() []byte {
 	icmpid := binary.BigEndian.Uint16(q.Sub(4, 2))
 	b := q.Trim()
+	if q.IPVersion == 6 {
+		return GenICMPv6(q.DstIP6, q.SrcIP6, ICMPv6EchoReply, 0, b[q.subofs+4:])
+	}
 	return GenICMP(q.DstIP, q.SrcIP, icmpid, ICMPEchoReply, 0, b[q.subofs+4:])
 }
 
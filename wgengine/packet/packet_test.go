@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func buildICMPv6(t *testing.T, srcIP, dstIP IP6, icmpType, icmpCode uint8) []byte {
+	t.Helper()
+	b := GenICMPv6(srcIP, dstIP, icmpType, icmpCode, []byte{0, 0, 0, 0})
+	if b == nil {
+		t.Fatalf("GenICMPv6 returned nil")
+	}
+	return b
+}
+
+func TestDecodeV6EchoRequest(t *testing.T) {
+	src := NewIP6(net.ParseIP("2001:db8::1"))
+	dst := NewIP6(net.ParseIP("2001:db8::2"))
+	b := buildICMPv6(t, src, dst, ICMPv6EchoRequest, 0)
+
+	var q QDecode
+	q.Decode(b)
+	if q.IPProto != ICMP {
+		t.Fatalf("IPProto = %v, want ICMP", q.IPProto)
+	}
+	if q.IPVersion != 6 {
+		t.Fatalf("IPVersion = %d, want 6", q.IPVersion)
+	}
+	if !q.IsEchoRequest() {
+		t.Fatalf("IsEchoRequest() = false, want true")
+	}
+	if q.IsEchoResponse() {
+		t.Fatalf("IsEchoResponse() = true, want false")
+	}
+	if q.IsError() {
+		t.Fatalf("IsError() = true, want false for an echo request")
+	}
+}
+
+func TestDecodeV6TimeExceededIsError(t *testing.T) {
+	src := NewIP6(net.ParseIP("2001:db8::1"))
+	dst := NewIP6(net.ParseIP("2001:db8::2"))
+	b := buildICMPv6(t, src, dst, ICMPv6TimeExceeded, 0)
+
+	var q QDecode
+	q.Decode(b)
+	if q.IPProto != ICMP {
+		t.Fatalf("IPProto = %v, want ICMP", q.IPProto)
+	}
+	if !q.IsError() {
+		t.Fatalf("IsError() = false, want true for ICMPv6 Time Exceeded")
+	}
+	if q.IsEchoRequest() || q.IsEchoResponse() {
+		t.Fatalf("an ICMPv6 error packet should not also look like an echo request/response")
+	}
+}
+
+func TestDecodeV4ErrorStillWorks(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+	b := GenICMP(src, dst, 99, ICMPTimeExceeded, 0, []byte{0, 0, 0, 0})
+	if b == nil {
+		t.Fatalf("GenICMP returned nil")
+	}
+
+	var q QDecode
+	q.Decode(b)
+	if q.IPVersion != 4 {
+		t.Fatalf("IPVersion = %d, want 4", q.IPVersion)
+	}
+	if !q.IsError() {
+		t.Fatalf("IsError() = false, want true for ICMPv4 Time Exceeded")
+	}
+}
+
+func TestDecodeV6UDP(t *testing.T) {
+	src := NewIP6(net.ParseIP("2001:db8::1"))
+	dst := NewIP6(net.ParseIP("2001:db8::2"))
+
+	payload := []byte("hello")
+	udpLen := 8 + len(payload)
+	b := make([]byte, 40+udpLen)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:6], uint16(udpLen))
+	b[6] = 17 // UDP
+	b[7] = 64
+	copy(b[8:24], src[:])
+	copy(b[24:40], dst[:])
+	binary.BigEndian.PutUint16(b[40:42], 1234)
+	binary.BigEndian.PutUint16(b[42:44], 5678)
+	binary.BigEndian.PutUint16(b[44:46], uint16(udpLen))
+	copy(b[48:], payload)
+
+	var q QDecode
+	q.Decode(b)
+	if q.IPProto != UDP {
+		t.Fatalf("IPProto = %v, want UDP", q.IPProto)
+	}
+	if q.SrcPort != 1234 || q.DstPort != 5678 {
+		t.Fatalf("SrcPort/DstPort = %d/%d, want 1234/5678", q.SrcPort, q.DstPort)
+	}
+	if q.SrcIP6 != src || q.DstIP6 != dst {
+		t.Fatalf("SrcIP6/DstIP6 = %v/%v, want %v/%v", q.SrcIP6, q.DstIP6, src, dst)
+	}
+}
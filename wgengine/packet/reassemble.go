@@ -0,0 +1,294 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+// Reassembler buffers IPv4 fragments and reassembles them into whole
+// datagrams, so that callers such as the firewall can inspect ports
+// and flags on every packet instead of only the first fragment.
+//
+// It is opt-in: QDecode.Decode still treats non-first fragments as
+// Fragment on its own. Callers that want full reassembly should feed
+// every packet with IPProto == Fragment (and the first fragment of a
+// fragmented datagram) through Insert before decoding it.
+type Reassembler struct {
+	// timeout is how long an incomplete datagram is kept around
+	// before it's given up on and, if the first fragment arrived,
+	// reported back to the sender as an ICMP Time Exceeded.
+	timeout time.Duration
+	// maxMemory bounds the total number of payload bytes buffered
+	// across all in-progress datagrams.
+	maxMemory int
+	// onTimeout, if non-nil, is called with the bytes of an ICMPv4
+	// Time Exceeded packet whenever a datagram whose first fragment
+	// was seen times out.
+	onTimeout func([]byte)
+
+	mu        sync.Mutex
+	frags     map[fragKey]*reassembly
+	curMemory int
+	closed    bool
+	done      chan struct{}
+}
+
+// fragKey identifies the fragments belonging to a single original
+// datagram, per RFC 791: the 4-tuple of source, destination, protocol
+// and IP identification field.
+type fragKey struct {
+	src, dst IP
+	proto    uint8
+	ipid     uint16
+}
+
+// hole describes a byte range [start, end) of a reassembly's buffer
+// that has not yet been filled in by any fragment, per RFC 815.
+type hole struct {
+	start, end int
+}
+
+type reassembly struct {
+	buf       []byte
+	holes     []hole
+	firstSeen time.Time
+
+	haveFirst  bool   // whether the offset-0 fragment has arrived
+	firstBytes []byte // IPv4 header + first 8 bytes of payload from that fragment, for ICMP Time Exceeded
+}
+
+var (
+	metricReassembled     = expvar.NewInt("packet_reassembly_reassembled")
+	metricTimedOut        = expvar.NewInt("packet_reassembly_timed_out")
+	metricDroppedOversize = expvar.NewInt("packet_reassembly_dropped_oversize")
+)
+
+// defaultReassemblyTimeout is how long we wait for the remaining
+// fragments of a datagram to arrive before giving up on it.
+const defaultReassemblyTimeout = 30 * time.Second
+
+// NewReassembler returns a Reassembler that buffers fragments for up
+// to timeout (or defaultReassemblyTimeout if zero) and buffers at
+// most maxBytes (or a conservative default if zero) of fragment
+// payload at a time. onTimeout, if non-nil, is invoked with a
+// ready-to-send ICMP Time Exceeded packet whenever a datagram times
+// out after its first fragment was seen.
+func NewReassembler(timeout time.Duration, maxBytes int, onTimeout func([]byte)) *Reassembler {
+	if timeout <= 0 {
+		timeout = defaultReassemblyTimeout
+	}
+	if maxBytes <= 0 {
+		maxBytes = 4 << 20 // 4 MiB of buffered fragment payload
+	}
+	r := &Reassembler{
+		timeout:   timeout,
+		maxMemory: maxBytes,
+		onTimeout: onTimeout,
+		frags:     make(map[fragKey]*reassembly),
+		done:      make(chan struct{}),
+	}
+	go r.sweepLoop()
+	return r
+}
+
+// Close stops the Reassembler's background timeout sweeper. It does
+// not flush or report on any in-progress datagrams.
+func (r *Reassembler) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	r.mu.Unlock()
+	close(r.done)
+}
+
+func (r *Reassembler) sweepLoop() {
+	t := time.NewTicker(r.timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-t.C:
+			r.sweep(now)
+		}
+	}
+}
+
+// sweep evicts any datagram whose first fragment arrived more than
+// r.timeout ago, emitting an ICMP Time Exceeded for any that got far
+// enough to have seen their offset-0 fragment.
+func (r *Reassembler) sweep(now time.Time) {
+	var timedOut [][]byte
+	nTimedOut := 0
+
+	r.mu.Lock()
+	for key, re := range r.frags {
+		if now.Sub(re.firstSeen) < r.timeout {
+			continue
+		}
+		delete(r.frags, key)
+		r.curMemory -= len(re.buf)
+		nTimedOut++
+		if re.haveFirst {
+			icmp := GenICMP(key.dst, key.src, key.ipid, ICMPTimeExceeded, 1, re.firstBytes)
+			if icmp != nil {
+				timedOut = append(timedOut, icmp)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	metricTimedOut.Add(int64(nTimedOut))
+	if len(timedOut) > 0 {
+		if r.onTimeout != nil {
+			for _, icmp := range timedOut {
+				r.onTimeout(icmp)
+			}
+		}
+	}
+}
+
+// Insert buffers the IPv4 fragment b (a full IP packet, including its
+// header) and reports whether b completed its datagram. If it did,
+// the returned buffer is a synthetic, non-fragmented IPv4 packet
+// suitable for passing to QDecode.Decode. If b is not itself
+// fragmented, it's returned as-is with ok true, so callers can feed
+// every packet through Insert unconditionally.
+func (r *Reassembler) Insert(b []byte) (full []byte, ok bool) {
+	if len(b) < 20 || ((b[0]&0xF0)>>4) != 4 {
+		return nil, false
+	}
+	headerLen := int(b[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < totalLen || totalLen < headerLen {
+		return nil, false
+	}
+	b = b[:totalLen]
+
+	fragFlags := binary.BigEndian.Uint16(b[6:8])
+	moreFrags := fragFlags&0x2000 != 0
+	fragOfs := int(fragFlags&0x1FFF) * 8
+	if fragOfs == 0 && !moreFrags {
+		// Not fragmented at all.
+		return b, true
+	}
+
+	key := fragKey{
+		src:   IP(binary.BigEndian.Uint32(b[12:16])),
+		dst:   IP(binary.BigEndian.Uint32(b[16:20])),
+		proto: b[9],
+		ipid:  binary.BigEndian.Uint16(b[4:6]),
+	}
+	payload := b[headerLen:]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+
+	re := r.frags[key]
+	if re == nil {
+		re = &reassembly{
+			firstSeen: time.Now(),
+			holes:     []hole{{0, math.MaxInt32}},
+		}
+		r.frags[key] = re
+	}
+
+	end := fragOfs + len(payload)
+	if end > len(re.buf) {
+		r.curMemory += end - len(re.buf)
+		grown := make([]byte, end)
+		copy(grown, re.buf)
+		re.buf = grown
+	}
+	copy(re.buf[fragOfs:end], payload)
+	re.holes = fillHole(re.holes, fragOfs, end)
+	if !moreFrags {
+		// This fragment ends the datagram; anything beyond it isn't
+		// part of the reassembled payload.
+		re.holes = fillHole(re.holes, end, math.MaxInt32)
+		if end < len(re.buf) {
+			re.buf = re.buf[:end]
+		}
+	}
+	if fragOfs == 0 && !re.haveFirst {
+		re.haveFirst = true
+		n := headerLen + 8
+		if n > len(b) {
+			n = len(b)
+		}
+		re.firstBytes = append([]byte(nil), b[:n]...)
+	}
+
+	if r.curMemory > r.maxMemory {
+		r.evictOldestLocked()
+	}
+
+	if len(re.holes) != 0 {
+		return nil, false
+	}
+
+	delete(r.frags, key)
+	r.curMemory -= len(re.buf)
+	metricReassembled.Add(1)
+
+	out := make([]byte, headerLen+len(re.buf))
+	copy(out, b[:headerLen])
+	copy(out[headerLen:], re.buf)
+	put16(out[2:4], uint16(len(out)))
+	put16(out[6:8], 0) // clear fragment flags/offset
+	out[10], out[11] = 0, 0
+	put16(out[10:12], ipChecksum(out[:headerLen]))
+	return out, true
+}
+
+// evictOldestLocked drops in-progress datagrams, oldest (by firstSeen)
+// first, until memory usage is back under budget. r.mu must be held.
+func (r *Reassembler) evictOldestLocked() {
+	for r.curMemory > r.maxMemory {
+		var oldestKey fragKey
+		var oldest *reassembly
+		for key, re := range r.frags {
+			if oldest == nil || re.firstSeen.Before(oldest.firstSeen) {
+				oldestKey, oldest = key, re
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(r.frags, oldestKey)
+		r.curMemory -= len(oldest.buf)
+		metricDroppedOversize.Add(1)
+	}
+}
+
+// fillHole removes the byte range [start, end) from holes, splitting
+// or shrinking any hole it overlaps, per RFC 815.
+func fillHole(holes []hole, start, end int) []hole {
+	out := holes[:0]
+	for _, h := range holes {
+		if end <= h.start || start >= h.end {
+			out = append(out, h)
+			continue
+		}
+		if start > h.start {
+			out = append(out, hole{h.start, start})
+		}
+		if end < h.end {
+			out = append(out, hole{end, h.end})
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildFrag returns an IPv4 packet carrying payload as a fragment at byte
+// offset fragOfs (which must be a multiple of 8), with the "more fragments"
+// flag set according to moreFrags.
+func buildFrag(src, dst IP, ipid uint16, fragOfs int, moreFrags bool, payload []byte) []byte {
+	b := make([]byte, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:6], ipid)
+	flags := uint16(fragOfs / 8)
+	if moreFrags {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(b[6:8], flags)
+	b[9] = 17 // UDP, arbitrary
+	binary.BigEndian.PutUint32(b[12:16], uint32(src))
+	binary.BigEndian.PutUint32(b[16:20], uint32(dst))
+	copy(b[20:], payload)
+	return b
+}
+
+func TestReassemblerMoreFragmentsBit(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+
+	first := buildFrag(src, dst, 42, 0, true, make([]byte, 16))
+	_, ok := (&Reassembler{maxMemory: 1 << 20, frags: map[fragKey]*reassembly{}}).Insert(first)
+	if ok {
+		t.Fatalf("first fragment (MF set) was reported complete, but more fragments remain")
+	}
+}
+
+func TestReassemblerReassemblesTwoFragments(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+	r := &Reassembler{maxMemory: 1 << 20, frags: map[fragKey]*reassembly{}}
+
+	part1 := []byte("0123456789abcdef") // 16 bytes, multiple of 8
+	part2 := []byte("ZZZZ")
+
+	if _, ok := r.Insert(buildFrag(src, dst, 7, 0, true, part1)); ok {
+		t.Fatalf("first fragment alone should not complete the datagram")
+	}
+	full, ok := r.Insert(buildFrag(src, dst, 7, len(part1), false, part2))
+	if !ok {
+		t.Fatalf("second (final) fragment did not complete the datagram")
+	}
+	gotPayload := full[20:]
+	wantPayload := append(append([]byte{}, part1...), part2...)
+	if string(gotPayload) != string(wantPayload) {
+		t.Fatalf("reassembled payload = %q, want %q", gotPayload, wantPayload)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DecodeUDPGRO decodes b, a single IPv4/UDP "super-packet" whose UDP
+// payload is segSize-byte segments concatenated together (the final
+// segment may be shorter), as produced by UDP_GRO on a Linux TUN
+// device. It validates the outer IPv4 and UDP headers once and emits
+// one QDecode per segment into out, each sharing the outer packet's
+// 5-tuple but with Sub and Trim scoped to just that segment's bytes.
+// It returns the number of QDecodes written, which is capped at
+// len(out); callers that want every segment should size out to
+// ceil(UDP payload length / segSize).
+//
+// DecodeUDPGRO returns 0 if b isn't a well-formed, non-fragmented
+// IPv4/UDP packet.
+func DecodeUDPGRO(b []byte, segSize uint16, out []QDecode) int {
+	if segSize == 0 || len(out) == 0 || len(b) < 28 {
+		return 0
+	}
+	if ((b[0] & 0xF0) >> 4) != 4 {
+		return 0
+	}
+	headerLen := int(b[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < totalLen || totalLen < headerLen+8 {
+		return 0
+	}
+	b = b[:totalLen]
+
+	fragFlags := binary.BigEndian.Uint16(b[6:8])
+	if fragFlags&0x3FFF != 0 {
+		// Fragmented; GRO super-packets are never fragmented, so
+		// bail rather than guess.
+		return 0
+	}
+	if b[9] != 17 { // UDP
+		return 0
+	}
+
+	srcIP := IP(binary.BigEndian.Uint32(b[12:16]))
+	dstIP := IP(binary.BigEndian.Uint32(b[16:20]))
+	srcPort := binary.BigEndian.Uint16(b[headerLen : headerLen+2])
+	dstPort := binary.BigEndian.Uint16(b[headerLen+2 : headerLen+4])
+	payload := b[headerLen+8:]
+
+	n := 0
+	for ofs := 0; ofs < len(payload) && n < len(out); n++ {
+		end := ofs + int(segSize)
+		if end > len(payload) {
+			end = len(payload)
+		}
+		q := &out[n]
+		*q = QDecode{}
+		q.IPVersion = 4
+		q.IPProto = UDP
+		q.SrcIP, q.DstIP = srcIP, dstIP
+		q.SrcPort, q.DstPort = srcPort, dstPort
+		q.b = payload[ofs:end]
+		q.subofs = 0
+		q.rawPayload = true
+		ofs = end
+	}
+	return n
+}
+
+// EncodeUDPGSO coalesces pkts, which must all be decoded IPv4 UDP
+// packets sharing the same 5-tuple, into a single outer IPv4/UDP
+// datagram in out plus the per-segment size, in the form expected by
+// UDP_SEGMENT on a Linux TUN device. Every packet's UDP payload must
+// be the same length, except the last packet's, which may be
+// shorter. EncodeUDPGSO returns an error if pkts is empty, any packet
+// isn't IPv4 UDP, the 5-tuples differ, payload sizes are non-uniform
+// other than the last, or out is too small to hold the result.
+//
+// The outer UDP checksum is left zero, matching the behavior of an
+// offloaded send; callers that need a checksum must compute it
+// themselves.
+func EncodeUDPGSO(pkts []QDecode, out []byte) (n int, segSize uint16, err error) {
+	if len(pkts) == 0 {
+		return 0, 0, errors.New("packet: EncodeUDPGSO: no packets")
+	}
+	first := pkts[0]
+	if first.IPVersion != 4 || first.IPProto != UDP {
+		return 0, 0, errors.New("packet: EncodeUDPGSO: only IPv4 UDP packets are supported")
+	}
+	for _, p := range pkts[1:] {
+		if p.IPVersion != 4 || p.IPProto != UDP ||
+			p.SrcIP != first.SrcIP || p.DstIP != first.DstIP ||
+			p.SrcPort != first.SrcPort || p.DstPort != first.DstPort {
+			return 0, 0, errors.New("packet: EncodeUDPGSO: packets have differing 5-tuples")
+		}
+	}
+
+	payloads := make([][]byte, len(pkts))
+	maxLen, totalLen := 0, 0
+	for i := range pkts {
+		b := pkts[i].Trim()
+		payload := b
+		if !pkts[i].rawPayload {
+			// A DecodeUDPGRO segment's b is already just its payload.
+			payload = b[pkts[i].subofs+8:]
+		}
+		payloads[i] = payload
+		totalLen += len(payload)
+		if len(payload) > maxLen {
+			maxLen = len(payload)
+		}
+	}
+	for _, payload := range payloads[:len(payloads)-1] {
+		if len(payload) != maxLen {
+			return 0, 0, errors.New("packet: EncodeUDPGSO: only the last segment may be shorter than the rest")
+		}
+	}
+	segSize = uint16(maxLen)
+
+	const outerHeaderLen = 20
+	udpLen := 8 + totalLen
+	n = outerHeaderLen + udpLen
+	if len(out) < n {
+		return 0, 0, errors.New("packet: EncodeUDPGSO: out buffer too small")
+	}
+
+	hdr := out[:outerHeaderLen]
+	hdr[0] = 0x45 // IPv4, 20-byte header
+	hdr[1] = 0x00
+	put16(hdr[2:4], uint16(n))
+	put16(hdr[4:6], 0) // IPID; caller assigns if needed before sending
+	put16(hdr[6:8], 0) // flags, offset: never fragmented
+	hdr[8] = 64        // TTL
+	hdr[9] = 17        // UDP
+	put32(hdr[12:16], uint32(first.SrcIP))
+	put32(hdr[16:20], uint32(first.DstIP))
+	put16(hdr[10:12], ipChecksum(hdr))
+
+	udp := out[outerHeaderLen : outerHeaderLen+8]
+	put16(udp[0:2], first.SrcPort)
+	put16(udp[2:4], first.DstPort)
+	put16(udp[4:6], uint16(udpLen))
+	put16(udp[6:8], 0) // checksum left blank; offloaded
+
+	ofs := outerHeaderLen + 8
+	for _, payload := range payloads {
+		copy(out[ofs:], payload)
+		ofs += len(payload)
+	}
+	return n, segSize, nil
+}
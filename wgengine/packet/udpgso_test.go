@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func buildUDPGROSuperPacket(src, dst IP, srcPort, dstPort uint16, payload []byte) []byte {
+	b := make([]byte, 28+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[9] = 17 // UDP
+	binary.BigEndian.PutUint32(b[12:16], uint32(src))
+	binary.BigEndian.PutUint32(b[16:20], uint32(dst))
+	binary.BigEndian.PutUint16(b[20:22], srcPort)
+	binary.BigEndian.PutUint16(b[22:24], dstPort)
+	binary.BigEndian.PutUint16(b[24:26], uint16(8+len(payload)))
+	copy(b[28:], payload)
+	return b
+}
+
+func buildUDPPacket(src, dst IP, srcPort, dstPort uint16, payload []byte) []byte {
+	b := make([]byte, 28+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	b[9] = 17 // UDP
+	binary.BigEndian.PutUint32(b[12:16], uint32(src))
+	binary.BigEndian.PutUint32(b[16:20], uint32(dst))
+	binary.BigEndian.PutUint16(b[20:22], srcPort)
+	binary.BigEndian.PutUint16(b[22:24], dstPort)
+	binary.BigEndian.PutUint16(b[24:26], uint16(8+len(payload)))
+	copy(b[28:], payload)
+	return b
+}
+
+func TestEncodeUDPGSORoundTrip(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+	payloads := [][]byte{
+		[]byte("0123456789"), // 10 bytes
+		[]byte("9876543210"), // 10 bytes
+		[]byte("short"),      // 5 bytes: shorter, but it's the last segment
+	}
+	pkts := make([]QDecode, len(payloads))
+	for i, payload := range payloads {
+		pkts[i].Decode(buildUDPPacket(src, dst, 1111, 2222, payload))
+	}
+
+	out := make([]byte, 1500)
+	n, segSize, err := EncodeUDPGSO(pkts, out)
+	if err != nil {
+		t.Fatalf("EncodeUDPGSO: %v", err)
+	}
+	if segSize != 10 {
+		t.Fatalf("segSize = %d, want 10", segSize)
+	}
+
+	decoded := make([]QDecode, 4)
+	got := DecodeUDPGRO(out[:n], segSize, decoded)
+	if got != len(payloads) {
+		t.Fatalf("DecodeUDPGRO returned %d segments, want %d", got, len(payloads))
+	}
+	for i, payload := range payloads {
+		if got := decoded[i].Trim(); string(got) != string(payload) {
+			t.Errorf("segment %d = %q, want %q", i, got, payload)
+		}
+	}
+}
+
+func TestEncodeUDPGSOErrors(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+	other := NewIP(net.ParseIP("9.9.9.9"))
+
+	t.Run("no packets", func(t *testing.T) {
+		if _, _, err := EncodeUDPGSO(nil, make([]byte, 1500)); err == nil {
+			t.Fatal("want error for empty pkts, got nil")
+		}
+	})
+
+	t.Run("differing 5-tuples", func(t *testing.T) {
+		var a, b QDecode
+		a.Decode(buildUDPPacket(src, dst, 1111, 2222, []byte("hello")))
+		b.Decode(buildUDPPacket(src, other, 1111, 2222, []byte("world")))
+		if _, _, err := EncodeUDPGSO([]QDecode{a, b}, make([]byte, 1500)); err == nil {
+			t.Fatal("want error for differing 5-tuples, got nil")
+		}
+	})
+
+	t.Run("non-uniform segment sizes", func(t *testing.T) {
+		var a, b QDecode
+		a.Decode(buildUDPPacket(src, dst, 1111, 2222, []byte("short")))
+		b.Decode(buildUDPPacket(src, dst, 1111, 2222, []byte("longerpayload")))
+		if _, _, err := EncodeUDPGSO([]QDecode{a, b}, make([]byte, 1500)); err == nil {
+			t.Fatal("want error for non-uniform segment sizes (first shorter than last), got nil")
+		}
+	})
+
+	t.Run("out buffer too small", func(t *testing.T) {
+		var a QDecode
+		a.Decode(buildUDPPacket(src, dst, 1111, 2222, []byte("0123456789")))
+		if _, _, err := EncodeUDPGSO([]QDecode{a}, make([]byte, 4)); err == nil {
+			t.Fatal("want error for undersized out buffer, got nil")
+		}
+	})
+}
+
+func TestDecodeUDPGROTrimDoesNotPanic(t *testing.T) {
+	src, dst := NewIP(net.ParseIP("1.2.3.4")), NewIP(net.ParseIP("5.6.7.8"))
+	payload := []byte("0123456789") // 10 bytes, shorter than an IPv4 header
+	b := buildUDPGROSuperPacket(src, dst, 1111, 2222, payload)
+
+	out := make([]QDecode, 4)
+	n := DecodeUDPGRO(b, 10, out)
+	if n != 1 {
+		t.Fatalf("DecodeUDPGRO returned %d segments, want 1", n)
+	}
+	q := &out[0]
+	if got := q.Trim(); string(got) != string(payload) {
+		t.Fatalf("Trim() = %q, want %q", got, payload)
+	}
+	if got := q.Sub(0, len(payload)); string(got) != string(payload) {
+		t.Fatalf("Sub(0, n) = %q, want %q", got, payload)
+	}
+}